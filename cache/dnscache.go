@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultNegativeTTL RFC 2308建议的负缓存ttl上限，SOA中未给出合理值或未配置NegativeTTL时使用
+const defaultNegativeTTL = 300 * time.Second
+
+// DNSCache 基于答案TTL的dns响应缓存，支持RFC 2308负缓存、stale-while-revalidate及SERVFAIL冷却
+type DNSCache struct {
+	mu      sync.RWMutex
+	entries map[string]*cacheEntry
+
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration // NXDOMAIN/NODATA的ttl上限
+	staleTTL    time.Duration // 过期后仍可命中的宽限期，命中时上层应异步刷新
+
+	servfailMu       sync.Mutex
+	servfail         map[string]time.Time // key: cacheKey|group -> 冷却截止时间
+	servfailCooldown time.Duration
+}
+
+type cacheEntry struct {
+	msg        *dns.Msg
+	expireAt   time.Time
+	staleUntil time.Time
+}
+
+// NewDNSCache 创建DNSCache。minTTL/maxTTL裁剪正常答案的ttl，negativeTTL是负缓存的ttl上限
+// (<=0时使用defaultNegativeTTL)，staleTTL是stale-while-revalidate的宽限期，servfailCooldown
+// 是同一个group连续SERVFAIL后的冷却时长
+func NewDNSCache(minTTL, maxTTL, negativeTTL, staleTTL, servfailCooldown time.Duration) *DNSCache {
+	if negativeTTL <= 0 {
+		negativeTTL = defaultNegativeTTL
+	}
+	return &DNSCache{
+		entries: map[string]*cacheEntry{}, minTTL: minTTL, maxTTL: maxTTL,
+		negativeTTL: negativeTTL, staleTTL: staleTTL,
+		servfail: map[string]time.Time{}, servfailCooldown: servfailCooldown,
+	}
+}
+
+// cacheKey 按问题名称、类型及ECS子网生成缓存key，不同子网的客户端不会互相污染缓存
+func cacheKey(request *dns.Msg) string {
+	question := request.Question[0]
+	key := strings.ToLower(question.Name) + strconv.Itoa(int(question.Qtype))
+	if ecs := formatECS(request); ecs != "" {
+		key += "." + ecs
+	}
+	return key
+}
+
+func formatECS(request *dns.Msg) string {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet.Address.String() + "/" + strconv.Itoa(int(subnet.SourceNetmask))
+		}
+	}
+	return ""
+}
+
+// Get 查询缓存。命中新鲜数据时stale为false；命中处于staleTTL宽限期内的过期数据时stale为true，
+// 调用方应立即把返回的答案下发给客户端，同时异步地用同一个group重新发起解析刷新缓存
+func (c *DNSCache) Get(request *dns.Msg) (r *dns.Msg, stale bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[cacheKey(request)]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(entry.staleUntil) {
+		return nil, false
+	}
+	r = entry.msg.Copy()
+	r.Id = request.Id
+	return r, now.After(entry.expireAt)
+}
+
+// Set 按RFC 2308规则存入响应：SERVFAIL不缓存；NXDOMAIN/NODATA按Authority段SOA的
+// min(Minttl, TTL)作为负缓存ttl(上限negativeTTL)；其余有answer的响应按答案最小ttl裁剪到
+// [minTTL, maxTTL]区间缓存
+func (c *DNSCache) Set(request, r *dns.Msg) {
+	if r == nil {
+		return
+	}
+	if r.Rcode == dns.RcodeServerFailure {
+		return
+	}
+	var ttl time.Duration
+	switch {
+	case len(r.Answer) > 0:
+		ttl = c.maxTTL
+		for _, rr := range r.Answer {
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		if ttl < c.minTTL {
+			ttl = c.minTTL
+		}
+	case r.Rcode == dns.RcodeNameError || r.Rcode == dns.RcodeSuccess:
+		ttl = negativeTTLFromSOA(r, c.negativeTTL)
+	default:
+		return
+	}
+	c.mu.Lock()
+	c.entries[cacheKey(request)] = &cacheEntry{
+		msg: r.Copy(), expireAt: time.Now().Add(ttl), staleUntil: time.Now().Add(ttl + c.staleTTL),
+	}
+	c.mu.Unlock()
+}
+
+// negativeTTLFromSOA 从响应的Authority段取出SOA记录，按min(Minttl, TTL)计算负缓存ttl，
+// 取不到SOA或计算结果超过cap时使用cap
+func negativeTTLFromSOA(r *dns.Msg, cap time.Duration) time.Duration {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			if d := time.Duration(ttl) * time.Second; d > 0 && d < cap {
+				return d
+			}
+			return cap
+		}
+	}
+	return cap
+}
+
+// Delete 清除所有问题名称以domain为后缀的缓存项，返回清除的数量，供/cache/flush使用
+func (c *DNSCache) Delete(domain string) int {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, entry := range c.entries {
+		if strings.HasSuffix(entry.msg.Question[0].Name, domain) || strings.HasPrefix(key, domain) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// MarkServfail 记录request对应的group刚刚返回了SERVFAIL，在servfailCooldown窗口内
+// ServfailCoolingDown会返回true，避免ServeDNS持续重复调度到同一个故障group
+func (c *DNSCache) MarkServfail(request *dns.Msg, group string) {
+	if c.servfailCooldown <= 0 {
+		return
+	}
+	c.servfailMu.Lock()
+	defer c.servfailMu.Unlock()
+	c.servfail[cacheKey(request)+"|"+group] = time.Now().Add(c.servfailCooldown)
+}
+
+// ServfailCoolingDown 判断request对应的group是否仍处于SERVFAIL冷却期内
+func (c *DNSCache) ServfailCoolingDown(request *dns.Msg, group string) bool {
+	c.servfailMu.Lock()
+	defer c.servfailMu.Unlock()
+	until, ok := c.servfail[cacheKey(request)+"|"+group]
+	return ok && time.Now().Before(until)
+}
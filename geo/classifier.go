@@ -0,0 +1,94 @@
+// Package geo 提供基于地理位置/ASN的ip分类能力，用于group派发
+package geo
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// Classifier 统一的地理位置/asn查询接口，实现需保证并发安全
+type Classifier interface {
+	Lookup(ip net.IP) (country string, asn uint)
+}
+
+// dbHandle 包装一个mmdb reader及其生命周期。close()在Refresh换上新reader后淘汰旧reader时调用，
+// 用mu做借还：close()必须等到所有已经进入lookup()的调用都返回之后才真正Close底层reader，
+// 否则并发的Lookup可能在reader.Close()已经munmap数据库文件后继续访问，读到已释放的内存
+type dbHandle struct {
+	reader *maxminddb.Reader
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (h *dbHandle) lookup(ip net.IP, record *geoRecord) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return fmt.Errorf("mmdb reader already closed")
+	}
+	return h.reader.Lookup(ip, record)
+}
+
+func (h *dbHandle) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	_ = h.reader.Close()
+}
+
+// MMDBClassifier 基于MaxMind mmdb数据库的Classifier实现。数据库本身只读，可在多个goroutine间共享读取，
+// 内部用atomic.Value包装，使Refresh能够热替换数据库而不阻塞正在进行的查询
+type MMDBClassifier struct {
+	db atomic.Value // *dbHandle
+}
+
+// NewMMDBClassifier 加载mmdb文件并生成MMDBClassifier
+func NewMMDBClassifier(path string) (*MMDBClassifier, error) {
+	c := &MMDBClassifier{}
+	if err := c.Refresh(path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh 重新加载mmdb文件并原子替换，旧的reader在替换后关闭。旧reader的close()会等待
+// 所有已经开始的Lookup调用完成，避免刚替换就close导致的use-after-unmap
+func (c *MMDBClassifier) Refresh(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("open mmdb %s error: %w", path, err)
+	}
+	handle := &dbHandle{reader: reader}
+	old, _ := c.db.Swap(handle).(*dbHandle)
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// Lookup 查询目标ip所属的国家代码(ISO 3166-1 alpha-2)及所属asn号码，查询失败时返回空值
+func (c *MMDBClassifier) Lookup(ip net.IP) (country string, asn uint) {
+	handle, _ := c.db.Load().(*dbHandle)
+	if handle == nil {
+		return "", 0
+	}
+	var record geoRecord
+	if err := handle.lookup(ip, &record); err != nil {
+		return "", 0
+	}
+	return record.Country.ISOCode, record.AutonomousSystemNumber
+}
@@ -0,0 +1,62 @@
+package geo
+
+import (
+	"net"
+	"strings"
+)
+
+// Predicate 判断目标ip是否匹配某条地理位置/asn规则。cache.RamSet已经实现了同名的Contain方法，
+// 因此现有基于RamSet的配置(CNIP/CNIPv6)无需改动即可当作一种Predicate使用
+type Predicate interface {
+	Contain(ip net.IP) bool
+}
+
+// countryPredicate 按国家代码匹配，代码前加"!"表示取反，用于"排除某国"的场景(如geo=["!CN"])
+type countryPredicate struct {
+	classifier Classifier
+	countries  map[string]bool
+	negate     bool
+}
+
+// CompileCountryPredicate 将TOML中配置的国家代码列表编译为Predicate
+func CompileCountryPredicate(classifier Classifier, codes []string) Predicate {
+	p := &countryPredicate{classifier: classifier, countries: map[string]bool{}}
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		if strings.HasPrefix(code, "!") {
+			p.negate = true
+			code = code[1:]
+		}
+		p.countries[strings.ToUpper(code)] = true
+	}
+	return p
+}
+
+func (p *countryPredicate) Contain(ip net.IP) bool {
+	country, _ := p.classifier.Lookup(ip)
+	matched := p.countries[strings.ToUpper(country)]
+	if p.negate {
+		return !matched
+	}
+	return matched
+}
+
+// asnPredicate 按asn号码匹配，用于geo_asn = [13335]这类配置
+type asnPredicate struct {
+	classifier Classifier
+	asns       map[uint]bool
+}
+
+// CompileASNPredicate 将TOML中配置的asn列表编译为Predicate
+func CompileASNPredicate(classifier Classifier, asns []int) Predicate {
+	p := &asnPredicate{classifier: classifier, asns: map[uint]bool{}}
+	for _, asn := range asns {
+		p.asns[uint(asn)] = true
+	}
+	return p
+}
+
+func (p *asnPredicate) Contain(ip net.IP) bool {
+	_, asn := p.classifier.Lookup(ip)
+	return p.asns[asn]
+}
@@ -0,0 +1,155 @@
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MemoryReader 纯内存的hosts实现，支持运行时增删记录，并将全量记录持久化到磁盘，
+// 重启后可通过NewMemoryReader重新加载
+type MemoryReader struct {
+	mu        sync.RWMutex
+	ipv4      map[string]string
+	ipv6      map[string]string
+	path      string     // 持久化文件路径，为空时只在内存中生效
+	persistMu sync.Mutex // 串行化persist()，避免并发Add/Remove各自触发一次persist时互相踩临时文件
+}
+
+// NewMemoryReader 创建MemoryReader，path存在时从中加载已有记录，格式为每行"hostname ip"
+func NewMemoryReader(path string) (*MemoryReader, error) {
+	r := &MemoryReader{ipv4: map[string]string{}, ipv6: map[string]string{}, path: path}
+	if path == "" {
+		return r, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open hosts file %s error: %w", path, err)
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		r.set(fields[0], fields[1])
+	}
+	return r, scanner.Err()
+}
+
+func (r *MemoryReader) set(hostname, ip string) {
+	hostname = strings.ToLower(dottedFQDN(hostname))
+	if ipv4 := net.ParseIP(ip).To4(); ipv4 != nil {
+		r.ipv4[hostname] = ipv4.String()
+	} else if ipv6 := net.ParseIP(ip).To16(); ipv6 != nil {
+		r.ipv6[hostname] = ipv6.String()
+	}
+}
+
+func dottedFQDN(hostname string) string {
+	if !strings.HasSuffix(hostname, ".") {
+		return hostname + "."
+	}
+	return hostname
+}
+
+// IP 返回hostname对应的ip地址文本，找不到时返回空字符串
+func (r *MemoryReader) IP(hostname string, ipv6 bool) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := r.ipv4
+	if ipv6 {
+		m = r.ipv6
+	}
+	return m[strings.ToLower(dottedFQDN(hostname))]
+}
+
+// Record 返回可直接交给dns.NewRR解析的资源记录文本
+func (r *MemoryReader) Record(hostname string, ipv6 bool) string {
+	ip := r.IP(hostname, ipv6)
+	if ip == "" {
+		return ""
+	}
+	rrType := "A"
+	if ipv6 {
+		rrType = "AAAA"
+	}
+	return fmt.Sprintf("%s 600 IN %s %s", dottedFQDN(hostname), rrType, ip)
+}
+
+// Add 新增或覆盖一条hosts记录，并同步持久化到磁盘
+func (r *MemoryReader) Add(hostname, ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid ip: %s", ip)
+	}
+	r.mu.Lock()
+	r.set(hostname, ip)
+	r.mu.Unlock()
+	return r.persist()
+}
+
+// Remove 删除一条hosts记录，并同步持久化到磁盘
+func (r *MemoryReader) Remove(hostname string, ipv6 bool) error {
+	r.mu.Lock()
+	m := r.ipv4
+	if ipv6 {
+		m = r.ipv6
+	}
+	delete(m, strings.ToLower(dottedFQDN(hostname)))
+	r.mu.Unlock()
+	return r.persist()
+}
+
+// Entries 返回当前全部记录，用于管理接口展示
+func (r *MemoryReader) Entries() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]string, len(r.ipv4)+len(r.ipv6))
+	for h, ip := range r.ipv4 {
+		out[h] = ip
+	}
+	for h, ip := range r.ipv6 {
+		out[h] = ip
+	}
+	return out
+}
+
+// persist 将全量记录原子地写回磁盘：先写临时文件，再rename覆盖，避免并发写入时文件损坏。
+// Add/Remove只用r.mu保护map本身的读写，并不互斥persist调用之间的临时文件写入+rename序列，
+// 因此这里额外用persistMu串行化persist，防止两次并发的Add/Remove各自写同一个tmp文件、
+// 互相覆盖或rename到一半被对方截断
+func (r *MemoryReader) persist() error {
+	if r.path == "" {
+		return nil
+	}
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tmp := r.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create temp hosts file error: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	for hostname, ip := range r.ipv4 {
+		_, _ = fmt.Fprintf(w, "%s %s\n", hostname, ip)
+	}
+	for hostname, ip := range r.ipv6 {
+		_, _ = fmt.Fprintf(w, "%s %s\n", hostname, ip)
+	}
+	if err = w.Flush(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("flush temp hosts file error: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("close temp hosts file error: %w", err)
+	}
+	return os.Rename(tmp, r.path)
+}
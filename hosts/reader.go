@@ -0,0 +1,10 @@
+// Package hosts 提供hosts记录的读取与（可选的）持久化写入能力
+package hosts
+
+// Reader 根据域名查询对应的hosts记录，找不到时返回空字符串
+type Reader interface {
+	// Record 返回可直接交给dns.NewRR解析的资源记录文本，如"example.com. 600 IN A 1.2.3.4"
+	Record(hostname string, ipv6 bool) string
+	// IP 返回hostname对应的ip地址文本，找不到时返回空字符串
+	IP(hostname string, ipv6 bool) string
+}
@@ -0,0 +1,34 @@
+package inbound
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+// ListenAndServeQueryLog 启动HTTP管理接口，暴露QueryLog的查询日志/统计/prometheus指标。
+// /querylog会回放每个客户端查询过的真实ip和域名，敏感度不低于chunk0-5的写操作控制面，
+// 因此要求必须配置token，否则拒绝启动，而不是静默裸奔
+func (handler *Handler) ListenAndServeQueryLog(addr, token string) error {
+	if handler.QueryLog == nil {
+		return fmt.Errorf("query log not configured")
+	}
+	if token == "" {
+		return fmt.Errorf("query log admin api requires a token")
+	}
+	auth := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			expect := "Bearer " + token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expect)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/querylog", auth(handler.QueryLog.ServeQueryLog))
+	mux.HandleFunc("/stats", auth(handler.QueryLog.ServeStats))
+	mux.HandleFunc("/metrics", auth(handler.QueryLog.ServeMetrics))
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,381 @@
+package inbound
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+)
+
+// AdminConfig 控制面相关配置
+type AdminConfig struct {
+	Addr        string `toml:"addr"`
+	Token       string `toml:"token"`       // bearer token，留空则只依赖mTLS
+	Cert        string `toml:"cert"`
+	Key         string `toml:"key"`
+	ClientCA    string `toml:"client_ca"`   // 配置后启用mTLS，要求客户端证书由该CA签发
+	JournalPath string `toml:"journal"`     // 变更journal文件路径，重启时可据此在on-disk toml基础上重放
+}
+
+// AdminServer 运行时管理接口：修改规则/hosts/缓存/分组配置而无需重启进程。
+// 所有写操作成功生效之后都会追加一条journal记录，便于重启后重放；对Handler的改动遵循既有的锁规则：
+// 整体替换(如matcher重建)在锁外完成，只在真正swap的瞬间持有Handler.Mux的写锁
+type AdminServer struct {
+	Handler    *Handler
+	Config     AdminConfig
+	HostsStore *hosts.MemoryReader
+	Reload     func() (*Handler, error) // 重新读取on-disk toml并生成新Handler，由调用方(main)提供
+
+	ruleMu    sync.RWMutex
+	ruleText  map[string]string // 各group当前生效的ABPlus规则原文，供GET /rules/{group}展示
+
+	journalMu sync.Mutex
+	journal   *os.File
+}
+
+// NewAdminServer 创建AdminServer，如配置了JournalPath则打开(或新建)journal文件用于追加写入。
+// Token和ClientCA二者必须至少配置一个，否则规则注入/hosts覆盖/缓存清空/强制reload等写操作
+// 会在没有任何鉴权的情况下完全开放
+func NewAdminServer(handler *Handler, conf AdminConfig, hostsStore *hosts.MemoryReader) (*AdminServer, error) {
+	if conf.Token == "" && conf.ClientCA == "" {
+		return nil, fmt.Errorf("admin api requires either token or client_ca to be configured")
+	}
+	a := &AdminServer{Handler: handler, Config: conf, HostsStore: hostsStore, ruleText: map[string]string{}}
+	if conf.JournalPath != "" {
+		if err := a.replayJournal(conf.JournalPath); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(conf.JournalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open admin journal %s error: %w", conf.JournalPath, err)
+		}
+		a.journal = f
+	}
+	return a, nil
+}
+
+// replayJournal 在打开journal文件进行追加写入之前，先重放其中已有的记录，使得管理接口在
+// 上一次运行期间对on-disk toml之上所做的修改(规则/hosts变更)不会因为进程重启而丢失。
+// cache.flush/reload两类entry没有需要恢复的状态(缓存本就从空开始、reload只是重新读取
+// 当前on-disk toml)，重放时直接跳过
+func (a *AdminServer) replayJournal(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open admin journal %s error: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Debugf("skip malformed admin journal entry: %v", err)
+			continue
+		}
+		switch entry.Op {
+		case "rules.put":
+			_ = a.swapMatcher(entry.Args["group"], entry.Args["rules"])
+		case "rules.delete":
+			_ = a.swapMatcher(entry.Args["group"], "")
+		case "hosts.put":
+			if a.HostsStore != nil {
+				_ = a.HostsStore.Add(entry.Args["hostname"], entry.Args["ip"])
+			}
+		case "hosts.delete":
+			if a.HostsStore != nil {
+				_ = a.HostsStore.Remove(entry.Args["hostname"], entry.Args["ipv6"] == "true")
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// journalEntry 一条journal记录，重启后replay以恢复用户通过管理接口所做的修改
+type journalEntry struct {
+	Time time.Time         `json:"time"`
+	Op   string            `json:"op"`
+	Args map[string]string `json:"args"`
+}
+
+func (a *AdminServer) appendJournal(op string, args map[string]string) {
+	if a.journal == nil {
+		return
+	}
+	raw, err := json.Marshal(journalEntry{Time: time.Now(), Op: op, Args: args})
+	if err != nil {
+		return
+	}
+	a.journalMu.Lock()
+	defer a.journalMu.Unlock()
+	_, _ = a.journal.Write(append(raw, '\n'))
+}
+
+// authMiddleware 校验bearer token；当仅依赖mTLS(Config.Token为空)时直接放行，证书已由tls层校验
+func (a *AdminServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Config.Token != "" {
+			auth := r.Header.Get("Authorization")
+			expect := "Bearer " + a.Config.Token
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(expect)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// mux 构建全部管理接口的路由
+func (a *AdminServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules/", a.authMiddleware(a.handleRules))
+	mux.HandleFunc("/hosts", a.authMiddleware(a.handleHosts))
+	mux.HandleFunc("/cache/flush", a.authMiddleware(a.handleCacheFlush))
+	mux.HandleFunc("/reload", a.authMiddleware(a.handleReload))
+	mux.HandleFunc("/groups/", a.authMiddleware(a.handleGroupsSubroute))
+	return mux
+}
+
+// ListenAndServe 启动管理接口监听，配置了ClientCA时启用mTLS
+func (a *AdminServer) ListenAndServe() error {
+	mux := a.mux()
+	if a.Config.ClientCA == "" {
+		return http.ListenAndServeTLS(a.Config.Addr, a.Config.Cert, a.Config.Key, mux)
+	}
+	caCert, err := ioutil.ReadFile(a.Config.ClientCA)
+	if err != nil {
+		return fmt.Errorf("read client ca %s error: %w", a.Config.ClientCA, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("parse client ca %s error", a.Config.ClientCA)
+	}
+	srv := &http.Server{
+		Addr: a.Config.Addr, Handler: mux,
+		TLSConfig: &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert},
+	}
+	return srv.ListenAndServeTLS(a.Config.Cert, a.Config.Key)
+}
+
+// handleRules 处理 GET/PUT/DELETE /rules/{group}，维护Group.Matcher对应的ABPlus规则
+func (a *AdminServer) handleRules(w http.ResponseWriter, r *http.Request) {
+	group := strings.TrimPrefix(r.URL.Path, "/rules/")
+	if group == "" {
+		http.Error(w, "missing group name", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		a.ruleMu.RLock()
+		text := a.ruleText[group]
+		a.ruleMu.RUnlock()
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(text))
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body error", http.StatusBadRequest)
+			return
+		}
+		if err = a.swapMatcher(group, string(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		a.appendJournal("rules.put", map[string]string{"group": group, "rules": string(body)})
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := a.swapMatcher(group, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		a.appendJournal("rules.delete", map[string]string{"group": group})
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// swapMatcher 在锁外编译新的matcher，只在真正替换的瞬间持有Handler.Mux的写锁，避免阻塞ServeDNS
+func (a *AdminServer) swapMatcher(group, text string) error {
+	newMatcher := matcher.NewABPlusByText(text)
+
+	a.Handler.Mux.Lock()
+	target, ok := a.Handler.Groups[group]
+	if ok {
+		target.Matcher = newMatcher
+	}
+	a.Handler.Mux.Unlock()
+	if !ok {
+		return fmt.Errorf("group %s not found", group)
+	}
+
+	a.ruleMu.Lock()
+	a.ruleText[group] = text
+	a.ruleMu.Unlock()
+	return nil
+}
+
+// hostsEntry PUT /hosts的请求体
+type hostsEntry struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+}
+
+// handleHosts 处理 GET/PUT/DELETE /hosts，底层由HostsStore(一个hosts.MemoryReader)维护并持久化
+func (a *AdminServer) handleHosts(w http.ResponseWriter, r *http.Request) {
+	if a.HostsStore == nil {
+		http.Error(w, "hosts store not configured", http.StatusNotImplemented)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(a.HostsStore.Entries())
+	case http.MethodPut:
+		var entry hostsEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, "malformed body", http.StatusBadRequest)
+			return
+		}
+		if err := a.HostsStore.Add(entry.Hostname, entry.IP); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.appendJournal("hosts.put", map[string]string{"hostname": entry.Hostname, "ip": entry.IP})
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		hostname := r.URL.Query().Get("hostname")
+		ipv6 := r.URL.Query().Get("ipv6") == "true"
+		if hostname == "" {
+			http.Error(w, "missing hostname", http.StatusBadRequest)
+			return
+		}
+		if err := a.HostsStore.Remove(hostname, ipv6); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.appendJournal("hosts.delete", map[string]string{"hostname": hostname, "ipv6": strconv.FormatBool(ipv6)})
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCacheFlush 处理 POST /cache/flush?domain=...
+func (a *AdminServer) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		http.Error(w, "missing domain", http.StatusBadRequest)
+		return
+	}
+	a.Handler.Mux.RLock()
+	removed := a.Handler.Cache.Delete(domain)
+	a.Handler.Mux.RUnlock()
+	a.appendJournal("cache.flush", map[string]string{"domain": domain})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
+
+// handleReload 处理 POST /reload：重新读取on-disk toml，生成新Handler后通过Refresh原子替换
+func (a *AdminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Reload == nil {
+		http.Error(w, "reload not configured", http.StatusNotImplemented)
+		return
+	}
+	target, err := a.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Handler.Refresh(target)
+	a.appendJournal("reload", nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// groupTestResult 单个caller的测试结果
+type groupTestResult struct {
+	Caller  string `json:"caller"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleGroupsSubroute 分发 /groups/{name}/test
+func (a *AdminServer) handleGroupsSubroute(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/groups/")
+	if !strings.HasSuffix(path, "/test") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimSuffix(path, "/test")
+	a.handleGroupTest(w, r, name)
+}
+
+// handleGroupTest 处理 POST /groups/{name}/test：对指定group发起一次真实解析，
+// 逐个记录每个outbound.Caller的应答延迟，返回最先给出有效应答的caller
+func (a *AdminServer) handleGroupTest(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.Handler.Mux.RLock()
+	group, ok := a.Handler.Groups[name]
+	a.Handler.Mux.RUnlock()
+	if !ok {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		domain = "example.com."
+	}
+	qtype := dns.TypeA
+	if r.URL.Query().Get("qtype") == "AAAA" {
+		qtype = dns.TypeAAAA
+	}
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(domain), qtype)
+
+	results := make([]groupTestResult, 0, len(group.Callers))
+	winner := ""
+	for _, caller := range group.Callers {
+		start := time.Now()
+		resp, err := caller.Call(request.Copy())
+		elapsed := time.Since(start)
+		res := groupTestResult{Caller: fmt.Sprintf("%v", caller), Latency: elapsed.String()}
+		if err != nil {
+			res.Error = err.Error()
+		} else if winner == "" && resp != nil {
+			winner = res.Caller
+		}
+		results = append(results, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"group": name, "winner": winner, "callers": results,
+	})
+}
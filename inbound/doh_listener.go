@@ -0,0 +1,101 @@
+package inbound
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// dohClientIP 在直连方的RemoteAddr落在TrustedProxies之内时，才信任其携带的
+// CF-Connecting-IP/X-Forwarded-For头取出真实客户端ip，否则直连方可随意伪造这两个头
+// 冒充任意客户端ip(进而影响chunk0-6的view匹配/ECS合成)，只能用RemoteAddr本身
+func (handler *Handler) dohClientIP(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remoteIP := net.ParseIP(host)
+	if handler.fromTrustedProxy(remoteIP) {
+		ip := r.Header.Get("CF-Connecting-IP")
+		if ip == "" {
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				ip = strings.TrimSpace(strings.Split(xff, ",")[0])
+			}
+		}
+		if parsed := net.ParseIP(ip); parsed != nil {
+			return &net.TCPAddr{IP: parsed}
+		}
+	}
+	return &net.TCPAddr{IP: remoteIP}
+}
+
+// fromTrustedProxy 判断ip是否落在配置的TrustedProxies网段内
+func (handler *Handler) fromTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range handler.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDoH 处理RFC 8484定义的DoH请求，支持GET ?dns=的base64url编码以及POST application/dns-message
+func (handler *Handler) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns param", http.StatusBadRequest)
+			return
+		}
+		raw, err = base64.RawURLEncoding.DecodeString(param)
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content-type", http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err = ioutil.ReadAll(r.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	request := new(dns.Msg)
+	if err = request.Unpack(raw); err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohResponseWriter{remoteAddr: handler.dohClientIP(r)}
+	handler.ServeDNS(writer, request)
+	if writer.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	body, err := writer.msg.Pack()
+	if err != nil {
+		http.Error(w, "pack response error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(body); err != nil {
+		log.Debugf("write doh response error: %v", err)
+	}
+}
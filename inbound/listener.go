@@ -0,0 +1,94 @@
+package inbound
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/miekg/dns"
+)
+
+// ListenerConfig 描述一个监听端口的配置，proto支持dot/doh；udp/tcp监听由Handler.Listen/Network配置
+type ListenerConfig struct {
+	Proto string `toml:"proto"`
+	Addr  string `toml:"addr"`
+	Cert  string `toml:"cert"`
+	Key   string `toml:"key"`
+	Path  string `toml:"path"` // doh查询路径，默认"/dns-query"
+	HTTP3 bool   `toml:"http3"`
+}
+
+// ListenAndServe 根据Listeners配置的各个监听端口启动服务，udp/tcp复用已有的Listen/Network逻辑，
+// 新增的dot/doh监听器共用同一个Handler.ServeDNS分发逻辑
+func (handler *Handler) ListenAndServe() error {
+	errCh := make(chan error, len(handler.Listeners)+1)
+	if handler.Listen != "" {
+		go func() {
+			srv := &dns.Server{Addr: handler.Listen, Net: handler.Network, Handler: handler}
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+	for _, conf := range handler.Listeners {
+		conf := conf
+		go func() {
+			errCh <- handler.serveListener(conf)
+		}()
+	}
+	return <-errCh
+}
+
+func (handler *Handler) serveListener(conf ListenerConfig) error {
+	switch conf.Proto {
+	case "dot":
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return fmt.Errorf("load dot cert/key error: %w", err)
+		}
+		srv := &dns.Server{
+			Addr: conf.Addr, Net: "tcp-tls", Handler: handler,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		log.Infof("start dot listener on %s", conf.Addr)
+		return srv.ListenAndServe()
+	case "doh":
+		path := conf.Path
+		if path == "" {
+			path = "/dns-query"
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(path, handler.serveDoH)
+		if conf.HTTP3 {
+			return handler.serveDoH3(conf, mux)
+		}
+		log.Infof("start doh listener on %s%s", conf.Addr, path)
+		return http.ListenAndServeTLS(conf.Addr, conf.Cert, conf.Key, mux)
+	default:
+		return fmt.Errorf("unsupported listener proto: %s", conf.Proto)
+	}
+}
+
+// dohResponseWriter 适配dns.ResponseWriter接口，用于在http handler中复用Handler.ServeDNS
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr          { return w.localAddr }
+func (w *dohResponseWriter) RemoteAddr() net.Addr         { return w.remoteAddr }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error    { w.msg = m; return nil }
+func (w *dohResponseWriter) Write(b []byte) (int, error)  { return len(b), nil }
+func (w *dohResponseWriter) Close() error                 { return nil }
+func (w *dohResponseWriter) TsigStatus() error            { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)          {}
+func (w *dohResponseWriter) Hijack()                      {}
+
+// serveDoH3 在同一个doh监听器地址上额外提供HTTP/3(QUIC)版本的DoH服务
+func (handler *Handler) serveDoH3(conf ListenerConfig, mux *http.ServeMux) error {
+	srv := &http3.Server{Addr: conf.Addr, Handler: mux}
+	log.Infof("start doh3 listener on %s", conf.Addr)
+	return srv.ListenAndServeTLS(conf.Cert, conf.Key)
+}
@@ -2,6 +2,7 @@ package inbound
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,24 +15,29 @@ import (
 	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/core/common"
 	"github.com/wolf-joe/ts-dns/core/context"
+	"github.com/wolf-joe/ts-dns/geo"
 	"github.com/wolf-joe/ts-dns/hosts"
 	"github.com/wolf-joe/ts-dns/matcher"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
+	"github.com/wolf-joe/ts-dns/views"
 )
 
 // Group 各域名组相关配置
 type Group struct {
-	Callers     []outbound.Caller
-	Matcher     *matcher.ABPlus
-	IPSet       *ipset.IPSet
-	Concurrent  bool
-	FastestV4   bool
-	TCPPingPort int
-	ECS         *dns.EDNS0_SUBNET
-	NoCookie    bool
-	TestIPv6    []string `toml:"test_ipv6"`
-	DisableIPv6 bool
-	Name        string
+	Callers      []outbound.Caller
+	Matcher      *matcher.ABPlus
+	IPSet        *ipset.IPSet
+	Concurrent   bool
+	FastestV4    bool
+	TCPPingPort  int
+	ECS          *dns.EDNS0_SUBNET
+	NoCookie     bool
+	TestIPv6     []string `toml:"test_ipv6"`
+	DisableIPv6  bool
+	Name         string
+	GeoPredicate geo.Predicate
+	QueryLog     *querylog.Logger // 非nil时，每次caller.Call的耗时都会上报为tsdns_upstream_latency_seconds
 }
 
 // CallDNS 向组内的dns服务器转发请求，可能返回nil
@@ -46,9 +52,19 @@ func (group *Group) callDNS(ctx *context.Context, request *dns.Msg) *dns.Msg {
 	}
 	// 并发用的channel
 	ch := make(chan *dns.Msg, len(group.Callers))
-	// 包裹Caller.Call，方便实现并发
+	// 包裹Caller.Call，方便实现并发。StartUpstream/EndUpstream记录本次上游查询耗时供调试日志
+	// 使用；同样的耗时还会上报给QueryLog.ObserveUpstream，供/metrics导出
+	// tsdns_upstream_latency_seconds{caller}使用
 	call := func(caller outbound.Caller, request *dns.Msg) *dns.Msg {
+		callerName := fmt.Sprintf("%v", caller)
+		ctx.StartUpstream(callerName)
+		start := time.Now()
 		r, err := caller.Call(request)
+		elapsed := time.Since(start)
+		ctx.EndUpstream(callerName)
+		if group.QueryLog != nil {
+			group.QueryLog.ObserveUpstream(callerName, elapsed)
+		}
 		if err != nil {
 			log.WithFields(ctx.Fields()).Debugf("query dns error: %v", err)
 		}
@@ -221,18 +237,91 @@ var condMap = make(CondMap)
 
 // Handler 存储主要配置的dns请求处理器，程序核心
 type Handler struct {
-	Mux           *sync.RWMutex
-	Listen        string
-	Network       string
-	DisableIPv6   bool
-	Cache         *cache.DNSCache
-	GFWMatcher    *matcher.ABPlus
-	CNIP          *cache.RamSet
-	CNIPv6        *cache.RamSet
-	HostsReaders  []hosts.Reader
-	Groups        map[string]*Group
-	QueryLogger   *log.Logger
-	DisableQTypes map[string]bool
+	Mux            *sync.RWMutex
+	Listen         string
+	Network        string
+	Listeners      []ListenerConfig
+	DisableIPv6    bool
+	Cache          *cache.DNSCache
+	GFWMatcher     *matcher.ABPlus
+	CNIP           *cache.RamSet
+	CNIPv6         *cache.RamSet
+	GeoClassifier  geo.Classifier
+	HostsReaders   []hosts.Reader
+	Groups         map[string]*Group
+	QueryLogger    *log.Logger
+	QueryLog       *querylog.Logger
+	DisableQTypes  map[string]bool
+	Views          []*views.Rule
+	TrustedNets    []*net.IPNet // 客户端ip落在其中时自动合成ECS(见views.SynthesizeECS)
+	TrustedProxies []*net.IPNet // 只有来自这些网段的连接才可信其CF-Connecting-IP/X-Forwarded-For头(见dohClientIP)
+}
+
+// matchView 按配置顺序返回第一个匹配客户端的视图规则，mac地址只在真正需要时才查一次arp表
+func (handler *Handler) matchView(clientIP net.IP) *views.Rule {
+	if len(handler.Views) == 0 || clientIP == nil {
+		return nil
+	}
+	var mac net.HardwareAddr
+	var macLookedUp bool
+	for _, rule := range handler.Views {
+		if rule.Match(clientIP, nil) {
+			return rule
+		}
+		if !macLookedUp && strings.HasPrefix(strings.TrimSpace(rule.MatchSpec), "mac:") {
+			mac = views.LookupMAC(clientIP)
+			macLookedUp = true
+		}
+		if mac != nil && rule.Match(clientIP, mac) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// clientIPFromAddr 从dns.ResponseWriter.RemoteAddr()中提取客户端ip
+func clientIPFromAddr(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+	return net.ParseIP(host)
+}
+
+// logQueryRecord 若配置了QueryLog，将本次查询封装为querylog.Record并非阻塞地提交给它。
+// 在ServeDNS写出响应之后才调用；Latency为从收到请求到此刻的总耗时(包含上游查询耗时)
+func (handler *Handler) logQueryRecord(resp dns.ResponseWriter, request, r *dns.Msg, group *Group, cacheHit bool, start time.Time) {
+	if handler.QueryLog == nil {
+		return
+	}
+	question := request.Question[0]
+	groupName := ""
+	if group != nil {
+		groupName = group.Name
+	}
+	clientIP := ""
+	if addr := resp.RemoteAddr(); addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			clientIP = host
+		} else {
+			clientIP = addr.String()
+		}
+	}
+	var answers []string
+	for _, a := range common.ExtractA(r) {
+		answers = append(answers, a.A.String())
+	}
+	for _, a := range common.ExtractAAAA(r) {
+		answers = append(answers, a.AAAA.String())
+	}
+	handler.QueryLog.Log(querylog.Record{
+		Time: start, ClientIP: clientIP, QName: question.Name,
+		QType: dns.TypeToString[question.Qtype], Group: groupName,
+		CacheHit: cacheHit, Latency: time.Since(start), Answers: answers, RCode: r.Rcode,
+	})
 }
 
 // HitHosts 如dns请求匹配hosts，则生成对应dns记录并返回。否则返回nil
@@ -273,8 +362,10 @@ func (handler *Handler) LogQuery(fields log.Fields, msg, group string) {
 func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 	handler.Mux.RLock() // 申请读锁，持续整个请求
 	ctx := context.NewContext(resp, request)
+	start := time.Now()
 	var r *dns.Msg
 	var group *Group
+	var cacheHit bool
 	defer func() {
 		if r == nil {
 			r = &dns.Msg{}
@@ -285,6 +376,7 @@ func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 		if group != nil {
 			group.AddIPSet(ctx, r) // 写入IPSet
 		}
+		handler.logQueryRecord(resp, request, r, group, cacheHit, start)
 		handler.Mux.RUnlock() // 读锁解除
 		_ = resp.Close()      // 结束连接
 	}()
@@ -292,7 +384,25 @@ func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 	question := request.Question[0]
 	log.WithFields(ctx.Fields()).
 		Debugf("question: %q, extract: %q", request.Question, request.Extra)
-	if handler.DisableIPv6 && question.Qtype == dns.TypeAAAA {
+
+	// 按客户端来源应用views覆盖：group强制指定、ecs合成、单独的ipv6开关
+	clientIP := clientIPFromAddr(resp.RemoteAddr())
+	disableIPv6, forcedGroup := handler.DisableIPv6, ""
+	if view := handler.matchView(clientIP); view != nil {
+		forcedGroup = view.GroupOverride
+		if view.DisableIPv6 {
+			disableIPv6 = true
+		}
+		if ecs, err := view.CompileECS(); err != nil {
+			log.WithFields(ctx.Fields()).Errorf("compile view ecs error: %v", err)
+		} else if ecs != nil {
+			common.SetDefaultECS(request, ecs)
+		}
+	} else if ecs := handler.synthesizeTrustedECS(clientIP); ecs != nil {
+		common.SetDefaultECS(request, ecs)
+	}
+
+	if disableIPv6 && question.Qtype == dns.TypeAAAA {
 		r = &dns.Msg{}
 		return // 禁用IPv6时直接返回
 	}
@@ -300,6 +410,12 @@ func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 		r = &dns.Msg{}
 		return // 禁用指定查询类型
 	}
+	if forcedGroup != "" {
+		if _, ok := handler.Groups[forcedGroup]; !ok {
+			log.WithFields(ctx.Fields()).Errorf("view group_override %q not found", forcedGroup)
+			forcedGroup = ""
+		}
+	}
 	// 检测是否命中hosts
 	if r = handler.HitHosts(ctx, request); r != nil {
 		handler.LogQuery(ctx.LogFields(), "hit hosts", "")
@@ -313,8 +429,13 @@ func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 	}
 	reqCond.cond.L.Unlock()
 
-	if r = handler.Cache.Get(request); r != nil {
+	var stale bool
+	if r, stale = handler.Cache.Get(request); r != nil {
+		cacheHit = true
 		handler.LogQuery(ctx.LogFields(), "hit cache", "")
+		if stale {
+			go handler.refreshStale(request)
+		}
 		return
 	}
 
@@ -329,89 +450,178 @@ func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 		reqCond.cond.L.Unlock()
 	}()
 
-	if r = handler.Cache.Get(request); r != nil {
+	if r, stale = handler.Cache.Get(request); r != nil {
+		cacheHit = true
 		handler.LogQuery(ctx.LogFields(), "hit cache", "")
+		if stale {
+			go handler.refreshStale(request)
+		}
 		return
 	}
 
+	var cacheable bool
+	r, group, cacheable = handler.resolveGroup(ctx, request, forcedGroup)
+	if cacheable {
+		handler.Cache.Set(request, r)
+	}
+}
+
+// callGroup 向group转发请求，SERVFAIL应答时记录冷却标记，处于冷却期内则直接跳过转发
+func (handler *Handler) callGroup(ctx *context.Context, request *dns.Msg, name string, group *Group) (r *dns.Msg, g *Group, servfail bool) {
+	if handler.Cache.ServfailCoolingDown(request, name) {
+		handler.LogQuery(ctx.LogFields(), "servfail cooldown", name)
+		return nil, group, true
+	}
+	r = group.CallDNS(ctx, request)
+	if r != nil && r.Rcode == dns.RcodeServerFailure {
+		handler.Cache.MarkServfail(request, name)
+		return r, group, true
+	}
+	return r, group, false
+}
+
+// resolveGroup 完整地走一遍view override/domain matcher/geo/cnip派发逻辑，返回最终应答、
+// 负责该应答的group，以及该应答是否应当写入缓存。hit-cache时的stale-while-revalidate会复用
+// 这个函数做异步刷新(此时forcedGroup固定传空，不重新计算view)
+func (handler *Handler) resolveGroup(ctx *context.Context, request *dns.Msg, forcedGroup string) (r *dns.Msg, group *Group, cacheable bool) {
+	if forcedGroup != "" {
+		// view.group_override：跳过domain matcher，强制走指定group，但仍复用与普通查询
+		// 相同的cache-check/condMap流程，确保同一client重复查询能命中缓存、被去重
+		target := handler.Groups[forcedGroup]
+		handler.LogQuery(ctx.LogFields(), "match view override", forcedGroup)
+		var servfail bool
+		r, group, servfail = handler.callGroup(ctx, request, forcedGroup, target)
+		return r, group, !servfail
+	}
+	question := request.Question[0]
 	// 判断域名是否匹配指定规则
 	var name string
 	if match, ok := handler.Groups["drop"].Matcher.Match(question.Name); ok && match {
-		return
+		return nil, nil, false
 	}
 	for name, group = range handler.Groups {
 		if match, ok := group.Matcher.Match(question.Name); ok && match {
 			handler.LogQuery(ctx.LogFields(), "match by rules", name)
-			r = group.CallDNS(ctx, request)
-			// 设置dns缓存
+			var servfail bool
+			r, group, servfail = handler.callGroup(ctx, request, name, group)
 			if name == "dirty" && r == nil {
-				group := handler.Groups["clean"]
-				r = group.CallDNS(ctx, request)
-			} else {
-				handler.Cache.Set(request, r)
+				cleanGroup := handler.Groups["clean"]
+				r, group, servfail = handler.callGroup(ctx, request, "clean", cleanGroup)
+				return r, group, !servfail
 			}
-			return
+			return r, group, !servfail
 		}
 	}
 	// 先用clean组dns解析
-	usingCache := true
-	group = handler.Groups["clean"] // 设置group变量以在defer里添加ipset
-	r = group.CallDNS(ctx, request)
-	if allInRange(r, handler.CNIP, handler.CNIPv6) {
-		// 出现cn ip，流程结束
+	cleanGroup := handler.Groups["clean"]
+	r, group, servfail := handler.callGroup(ctx, request, "clean", cleanGroup)
+	if servfail {
+		return r, group, false
+	}
+	if handler.GeoClassifier != nil {
+		// 已配置geo数据库，按各group声明的GeoPredicate派发
+		if name, ok := geoMatchGroup(handler.Groups, r); ok && name != "clean" {
+			dst := handler.Groups[name]
+			rr, dstGroup, dstServfail := handler.callGroup(ctx, request, name, dst)
+			if rr != nil {
+				handler.LogQuery(ctx.LogFields(), "match geo predicate", name)
+				return rr, dstGroup, !dstServfail
+			}
+			handler.LogQuery(ctx.LogFields(), "using clean", name)
+			return r, group, false
+		}
 		if len(common.ExtractA(r))+len(common.ExtractAAAA(r)) == 0 {
 			handler.LogQuery(ctx.LogFields(), "no ip found", "none")
 		} else {
-			handler.LogQuery(ctx.LogFields(), "match cnip", "clean")
+			handler.LogQuery(ctx.LogFields(), "match geo predicate", "clean")
 		}
-	} else {
-		// 非cn ip，用dirty组dns再次解析
-		group = handler.Groups["dirty"] // 设置group变量以在defer里添加ipset
-		rr := group.CallDNS(ctx, request)
-		if rr != nil {
-			handler.LogQuery(ctx.LogFields(), "not match cnip", "dirty")
-			r = rr
+		return r, group, true
+	}
+	if allInRange(r, handler.CNIP, handler.CNIPv6) {
+		// 未配置geo数据库，沿用基于CNIP/CNIPv6的规则判断
+		if len(common.ExtractA(r))+len(common.ExtractAAAA(r)) == 0 {
+			handler.LogQuery(ctx.LogFields(), "no ip found", "none")
 		} else {
-			handler.LogQuery(ctx.LogFields(), "using clean", "dirty")
-			usingCache = false
+			handler.LogQuery(ctx.LogFields(), "match cnip", "clean")
 		}
+		return r, group, true
+	}
+	// 非cn ip，用dirty组dns再次解析
+	dirtyGroup := handler.Groups["dirty"]
+	rr, dirtyG, dirtyServfail := handler.callGroup(ctx, request, "dirty", dirtyGroup)
+	if rr != nil {
+		handler.LogQuery(ctx.LogFields(), "not match cnip", "dirty")
+		return rr, dirtyG, !dirtyServfail
 	}
-	// 设置dns缓存
-	if usingCache {
+	handler.LogQuery(ctx.LogFields(), "using clean", "dirty")
+	return r, group, false
+}
+
+// staleRefreshing 去重并发的stale-while-revalidate刷新，与condMap的cache-miss singleflight
+// 完全独立：后者的reqCond.ready在刷新期间被占用会让同一cache key上的其它请求阻塞在
+// ServeDNS开头的cond.Wait()里，等于白白等完整个刷新耗时，违背了stale应答"不阻塞客户端"的初衷
+var staleRefreshing sync.Map // key: cache key, value: struct{}{}
+
+// refreshStale 对一条已经过期但仍在stale宽限期内的缓存记录发起异步刷新，不影响已经下发给
+// 客户端的stale应答；同一cache key同时只允许一次刷新在进行
+func (handler *Handler) refreshStale(request *dns.Msg) {
+	key := condMap.getCacheKey(request)
+	if _, loaded := staleRefreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	defer staleRefreshing.Delete(key)
+
+	handler.Mux.RLock()
+	defer handler.Mux.RUnlock()
+	ctx := context.NewEmptyContext(int(request.Id))
+	r, _, cacheable := handler.resolveGroup(ctx, request, "")
+	if cacheable {
 		handler.Cache.Set(request, r)
 	}
 }
 
-// ResolveDoH 为DoHCaller解析域名，只需要调用一次。考虑到回环解析，建议在ServerDNS开始后异步调用
-func (handler *Handler) ResolveDoH() {
-	resolveDoH := func(caller *outbound.DoHCaller) {
-		domain, ip := caller.Host, ""
+// hostResolveCaller 描述了ResolveHost能够处理的caller：持有一个待解析的域名(Host)，
+// 解析结果写入Servers，找不到hosts记录时退回自带的resolve方法
+type hostResolveCaller interface {
+	outbound.Caller
+	hostAndServers() (host string, servers []string)
+	setServers(servers []string)
+	resolve() error
+}
+
+// ResolveHost 为DoHCaller/DoTCaller/DoQCaller解析域名，只需要调用一次。
+// 考虑到回环解析，建议在ServerDNS开始后异步调用
+func (handler *Handler) ResolveHost() {
+	resolveOne := func(caller hostResolveCaller) {
+		domain, existed := caller.hostAndServers()
+		var servers []string
 		// 判断是否有对应Hosts记录
 		for _, reader := range handler.HostsReaders {
-			if ip = reader.IP(domain, false); ip == "" {
+			ip := reader.IP(domain, false)
+			if ip == "" {
 				ip = reader.IP(domain+".", false)
 			}
 			if ip != "" {
-				caller.Servers = append(caller.Servers, ip)
+				servers = append(servers, ip)
 			}
 		}
-		// 未找到对应hosts记录则使用DoHCaller的Resolve
-		if len(caller.Servers) <= 0 {
-			if err := caller.Resolve(); err != nil {
-				log.Errorf("resolve doh host error: %v", err)
+		if len(servers) > 0 {
+			caller.setServers(servers)
+		} else if len(existed) <= 0 {
+			// 未找到对应hosts记录则使用caller自带的resolve
+			if err := caller.resolve(); err != nil {
+				log.Errorf("resolve host %s error: %v", domain, err)
 				return
 			}
 		}
-		log.Infof("resolve doh (%s): %v", caller.Host, caller.Servers)
+		_, servers = caller.hostAndServers()
+		log.Infof("resolve host (%s): %v", domain, servers)
 	}
-	// 遍历所有DoHCaller解析host
+	// 遍历所有需要解析host的caller
 	for _, group := range handler.Groups {
 		for _, caller := range group.Callers {
-			switch v := caller.(type) {
-			case *outbound.DoHCaller:
-				resolveDoH(v)
-			default:
-				continue
+			if v, ok := caller.(hostResolveCaller); ok {
+				resolveOne(v)
 			}
 		}
 	}
@@ -431,6 +641,9 @@ func (handler *Handler) Refresh(target *Handler) {
 	if target.CNIP != nil {
 		handler.CNIP = target.CNIP
 	}
+	if target.GeoClassifier != nil {
+		handler.GeoClassifier = target.GeoClassifier
+	}
 	if target.HostsReaders != nil {
 		handler.HostsReaders = target.HostsReaders
 	}
@@ -440,7 +653,31 @@ func (handler *Handler) Refresh(target *Handler) {
 	if target.QueryLogger != nil {
 		handler.QueryLogger = target.QueryLogger
 	}
+	if target.Listeners != nil {
+		handler.Listeners = target.Listeners
+	}
+	if target.QueryLog != nil {
+		handler.QueryLog = target.QueryLog
+	}
+	if target.Views != nil {
+		handler.Views = target.Views
+	}
+	if target.TrustedNets != nil {
+		handler.TrustedNets = target.TrustedNets
+	}
+	if target.TrustedProxies != nil {
+		handler.TrustedProxies = target.TrustedProxies
+	}
 	handler.DisableIPv6 = target.DisableIPv6
+	handler.wireGroupQueryLog()
+}
+
+// wireGroupQueryLog 把handler.QueryLog同步给每个group，使group.callDNS在每次caller.Call后
+// 能把上游耗时上报给querylog统计，而不必让Group自己持有一份Handler引用
+func (handler *Handler) wireGroupQueryLog() {
+	for _, group := range handler.Groups {
+		group.QueryLog = handler.QueryLog
+	}
 }
 
 // IsValid 判断Handler是否符合运行条件
@@ -3,6 +3,7 @@ package inbound
 import (
 	"math"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -12,27 +13,69 @@ import (
 	"github.com/sparrc/go-ping"
 	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/core/common"
+	"github.com/wolf-joe/ts-dns/views"
 )
 
 const maxRtt = 500
 
-func allInRange(r *dns.Msg, ipRange *cache.RamSet) bool {
+func allInRange(r *dns.Msg, ipv4Range, ipv6Range *cache.RamSet) bool {
 	ret := true
 	for _, a := range common.ExtractA(r) {
 		ipv4 := net.ParseIP(a.A.String()).To4()
-		if ipv4 != nil && !ipRange.Contain(ipv4) {
+		if ipv4 != nil && !ipv4Range.Contain(ipv4) {
 			return false
 		}
 	}
 	for _, a := range common.ExtractAAAA(r) {
 		ipv6 := net.ParseIP(a.AAAA.String()).To16()
-		if ipv6 != nil && !ipRange.Contain(ipv6) {
+		if ipv6 != nil && !ipv6Range.Contain(ipv6) {
 			return false
 		}
 	}
 	return ret
 }
 
+// synthesizeTrustedECS 若clientIP落在TrustedNets中的任意一个网段，则按RFC 7871为其合成ECS，
+// 替代原先写死的静态override
+func (handler *Handler) synthesizeTrustedECS(clientIP net.IP) *dns.EDNS0_SUBNET {
+	if clientIP == nil {
+		return nil
+	}
+	for _, subnet := range handler.TrustedNets {
+		if subnet.Contains(clientIP) {
+			return views.SynthesizeECS(clientIP)
+		}
+	}
+	return nil
+}
+
+// geoMatchGroup 遍历groups（按名称排序以保证每次判断结果一致），返回第一个GeoPredicate
+// 命中r中任意A/AAAA记录的group名称。未配置GeoPredicate的group会被跳过
+func geoMatchGroup(groups map[string]*Group, r *dns.Msg) (name string, ok bool) {
+	names := make([]string, 0, len(groups))
+	for n := range groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		predicate := groups[n].GeoPredicate
+		if predicate == nil {
+			continue
+		}
+		for _, a := range common.ExtractA(r) {
+			if predicate.Contain(a.A) {
+				return n, true
+			}
+		}
+		for _, a := range common.ExtractAAAA(r) {
+			if predicate.Contain(a.AAAA) {
+				return n, true
+			}
+		}
+	}
+	return "", false
+}
+
 // 获取到目标ip的ping值（毫秒），当tcpPort大于0时使用tcp ping，否则使用icmp ping
 func pingRtt(ip string, tcpPort int) (rtt int64) {
 	if tcpPort > 0 { // 使用tcp ping
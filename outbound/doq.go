@@ -0,0 +1,178 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	quic "github.com/quic-go/quic-go"
+)
+
+// doqALPN RFC 9250 规定的应用层协议协商标识
+var doqALPN = []string{"doq"}
+
+// doqIdleTimeout 连接在没有请求后多久被回收，与dot.go的dotIdleTimeout保持一致
+const doqIdleTimeout = 60 * time.Second
+
+// DoQCaller 通过DNS-over-QUIC(RFC 9250)转发dns请求，每条请求使用独立的双向流，
+// 连接本身在多个请求间/多个goroutine间复用
+type DoQCaller struct {
+	Host    string // 服务器域名
+	Servers []string
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	sess     quic.Connection
+	lastUse  time.Time
+	evicting bool
+}
+
+// NewDoQCaller 生成DoQCaller实例，caller为"quic://host:port"形式的url中解析出的字段
+func NewDoQCaller(host string, servers []string) *DoQCaller {
+	return &DoQCaller{Host: host, Servers: servers, Timeout: 5 * time.Second}
+}
+
+// getSession 获取可复用的quic连接，如连接已失效则重新建立
+func (c *DoQCaller) getSession() (quic.Connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		select {
+		case <-c.sess.Context().Done():
+			c.sess = nil
+			c.evicting = false // 旧连接的evictIdle发现c.sess已变更后会直接退出，需为新连接重新启动
+		default:
+			c.lastUse = time.Now()
+			return c.sess, nil
+		}
+	}
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("doq caller %s has no resolved server", c.Host)
+	}
+	var lastErr error
+	for _, server := range c.Servers {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		sess, err := quic.DialAddr(ctx, server, &tls.Config{ServerName: c.Host, NextProtos: doqALPN}, nil)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("dial doq server %s error: %w", server, err)
+			continue
+		}
+		c.sess = sess
+		c.lastUse = time.Now()
+		if !c.evicting {
+			c.evicting = true
+			go c.evictIdle(sess)
+		}
+		return sess, nil
+	}
+	return nil, lastErr
+}
+
+// idle 连接是否已超过doqIdleTimeout未被使用，调用方需持有c.mu
+func (c *DoQCaller) idle() bool {
+	return time.Since(c.lastUse) > doqIdleTimeout
+}
+
+// evictIdle 定期检查连接是否长时间空闲，空闲则关闭并清空当前连接，下次Call时会重新拨号。
+// 避免空闲的quic连接无限期占用本地资源
+func (c *DoQCaller) evictIdle(sess quic.Connection) {
+	ticker := time.NewTicker(doqIdleTimeout)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		if c.sess != sess {
+			c.mu.Unlock()
+			return
+		}
+		if c.idle() {
+			c.sess = nil
+			c.evicting = false
+			c.mu.Unlock()
+			_ = sess.CloseWithError(0, "idle timeout")
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Call 新建一条双向流转发dns请求，满足RFC 9250 4.2节"每个请求/响应使用独立的流"的要求。
+// 超时仍然只按c.Timeout控制：Caller接口目前不带context参数，调用方（Group.callDNS）
+// 也无法传入外部取消信号，这里维持与DoTCaller.Call一致的行为
+func (c *DoQCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	sess, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open doq stream error: %w", err)
+	}
+	defer func() { _ = stream.Close() }()
+
+	// DoQ要求query id固定为0
+	query := request.Copy()
+	query.Id = 0
+	raw, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack doq request error: %w", err)
+	}
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(raw)))
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if _, err = stream.Write(append(prefix, raw...)); err != nil {
+		return nil, fmt.Errorf("write doq request error: %w", err)
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err = io.ReadFull(stream, lenBuf); err != nil {
+		return nil, fmt.Errorf("read doq response length error: %w", err)
+	}
+	size := binary.BigEndian.Uint16(lenBuf)
+	body := make([]byte, size)
+	if _, err = io.ReadFull(stream, body); err != nil {
+		return nil, fmt.Errorf("read doq response error: %w", err)
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpack doq response error: %w", err)
+	}
+	resp.Id = request.Id
+	return resp, nil
+}
+
+func (c *DoQCaller) String() string {
+	return fmt.Sprintf("DoQCaller<%s>", c.Host)
+}
+
+func (c *DoQCaller) hostAndServers() (string, []string) {
+	return c.Host, c.Servers
+}
+
+func (c *DoQCaller) setServers(servers []string) {
+	c.Servers = servers
+}
+
+// resolve 在没有对应hosts记录时，用系统默认解析器解析Host
+func (c *DoQCaller) resolve() error {
+	ips, err := net.LookupHost(c.Host)
+	if err != nil {
+		return fmt.Errorf("resolve doq host %s error: %w", c.Host, err)
+	}
+	servers := make([]string, len(ips))
+	for i, ip := range ips {
+		servers[i] = net.JoinHostPort(ip, "853")
+	}
+	c.Servers = servers
+	return nil
+}
@@ -0,0 +1,259 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// dotIdleTimeout 连接在没有请求后多久被回收
+const dotIdleTimeout = 60 * time.Second
+
+// dotConn 一条可复用的DoT长连接，支持乱序的请求/响应匹配
+type dotConn struct {
+	conn    *tls.Conn
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	nextID  uint16
+	lastUse time.Time
+	closed  bool
+}
+
+// allocID 分配一个当前未被占用的on-wire查询id，调用方需持有c.mu。连接被多个并发
+// 调用者复用，不能直接沿用client请求自带的16位Id，否则两个并发请求撞id时会彼此
+// 顶替对方在pending中的channel
+func (c *dotConn) allocID() uint16 {
+	for {
+		id := c.nextID
+		c.nextID++
+		if _, ok := c.pending[id]; !ok {
+			return id
+		}
+	}
+}
+
+func dialDoTConn(server, sni string, timeout time.Duration) (*dotConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", server, &tls.Config{ServerName: sni})
+	if err != nil {
+		return nil, fmt.Errorf("dial dot server %s error: %w", server, err)
+	}
+	c := &dotConn{conn: conn, pending: map[uint16]chan *dns.Msg{}, lastUse: time.Now()}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop 持续从长连接中读取带2字节长度前缀的响应，按Msg.Id分发给等待者
+func (c *dotConn) readLoop() {
+	lenBuf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, lenBuf); err != nil {
+			c.closeWithError(err)
+			return
+		}
+		size := binary.BigEndian.Uint16(lenBuf)
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(c.conn, raw); err != nil {
+			c.closeWithError(err)
+			return
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(raw); err != nil {
+			log.Debugf("unpack dot response error: %v", err)
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		if ok {
+			delete(c.pending, resp.Id)
+		}
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *dotConn) closeWithError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	log.Debugf("dot connection closed: %v", err)
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	_ = c.conn.Close()
+}
+
+func (c *dotConn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && len(c.pending) == 0 && time.Since(c.lastUse) > dotIdleTimeout
+}
+
+func (c *dotConn) call(request *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("dot connection already closed")
+	}
+	wireID := c.allocID()
+	c.pending[wireID] = ch
+	c.lastUse = time.Now()
+	c.mu.Unlock()
+
+	query := request.Copy()
+	query.Id = wireID
+	raw, err := query.Pack()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, wireID)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("pack dot request error: %w", err)
+	}
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(raw)))
+
+	if err = c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err = c.conn.Write(append(prefix, raw...)); err != nil {
+		return nil, fmt.Errorf("write dot request error: %w", err)
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("dot connection closed while waiting response")
+		}
+		resp.Id = request.Id
+		return resp, nil
+	case <-time.After(timeout):
+		c.mu.Lock()
+		delete(c.pending, wireID)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("wait dot response timeout")
+	}
+}
+
+// DoTCaller 通过DNS-over-TLS(RFC 7858)转发dns请求，支持连接池和乱序的请求/响应匹配
+type DoTCaller struct {
+	Host    string // 服务器域名，用于解析出Servers及建立tls连接时的sni
+	Servers []string
+	SNI     string
+	ECS     *dns.EDNS0_SUBNET
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*dotConn
+}
+
+// NewDoTCaller 生成DoTCaller实例，caller为"tls://host:port?sni=xxx"形式的url中解析出的字段
+func NewDoTCaller(host string, servers []string, sni string) *DoTCaller {
+	return &DoTCaller{Host: host, Servers: servers, SNI: sni, Timeout: 5 * time.Second}
+}
+
+func (c *DoTCaller) sni() string {
+	if c.SNI != "" {
+		return c.SNI
+	}
+	return c.Host
+}
+
+// getConn 获取一条可用的长连接，如不存在或已失效则新建
+func (c *DoTCaller) getConn(server string) (*dotConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = map[string]*dotConn{}
+	}
+	if conn, ok := c.conns[server]; ok && !conn.closed {
+		return conn, nil
+	}
+	conn, err := dialDoTConn(server, c.sni(), c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[server] = conn
+	go c.evictIdle(server, conn)
+	return conn, nil
+}
+
+// evictIdle 定期检查连接是否长时间空闲，空闲则关闭并从连接池中移除
+func (c *DoTCaller) evictIdle(server string, conn *dotConn) {
+	ticker := time.NewTicker(dotIdleTimeout)
+	defer ticker.Stop()
+	for range ticker.C {
+		if conn.idle() {
+			c.mu.Lock()
+			if c.conns[server] == conn {
+				delete(c.conns, server)
+			}
+			c.mu.Unlock()
+			conn.closeWithError(fmt.Errorf("idle timeout"))
+			return
+		}
+		if conn.closed {
+			return
+		}
+	}
+}
+
+// Call 向DoT服务器转发dns请求，返回响应
+func (c *DoTCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("dot caller %s has no resolved server", c.Host)
+	}
+	var lastErr error
+	for _, server := range c.Servers {
+		if !strings.Contains(server, ":") {
+			server += ":853"
+		}
+		conn, connErr := c.getConn(server)
+		if connErr != nil {
+			lastErr = connErr
+			continue
+		}
+		r, err = conn.call(request, c.Timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("dot query to %s error: %w", server, err)
+			continue
+		}
+		return r, nil
+	}
+	return nil, lastErr
+}
+
+func (c *DoTCaller) String() string {
+	return fmt.Sprintf("DoTCaller<%s>", c.Host)
+}
+
+func (c *DoTCaller) hostAndServers() (string, []string) {
+	return c.Host, c.Servers
+}
+
+func (c *DoTCaller) setServers(servers []string) {
+	c.Servers = servers
+}
+
+// resolve 在没有对应hosts记录时，用系统默认解析器解析Host
+func (c *DoTCaller) resolve() error {
+	ips, err := net.LookupHost(c.Host)
+	if err != nil {
+		return fmt.Errorf("resolve dot host %s error: %w", c.Host, err)
+	}
+	c.Servers = ips
+	return nil
+}
@@ -0,0 +1,38 @@
+package outbound
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// NewDoTCallerFromURL 从url形式的配置(如"tls://1.1.1.1:853?sni=cloudflare-dns.com")生成DoTCaller
+func NewDoTCallerFromURL(rawurl string) (*DoTCaller, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse dot url %q error: %w", rawurl, err)
+	}
+	if u.Scheme != "tls" {
+		return nil, fmt.Errorf("invalid dot url scheme: %s", u.Scheme)
+	}
+	caller := NewDoTCaller(u.Hostname(), nil, u.Query().Get("sni"))
+	if port := u.Port(); port != "" {
+		caller.Servers = []string{u.Hostname() + ":" + port}
+	}
+	return caller, nil
+}
+
+// NewDoQCallerFromURL 从url形式的配置(如"quic://dns.adguard.com:853")生成DoQCaller
+func NewDoQCallerFromURL(rawurl string) (*DoQCaller, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse doq url %q error: %w", rawurl, err)
+	}
+	if u.Scheme != "quic" {
+		return nil, fmt.Errorf("invalid doq url scheme: %s", u.Scheme)
+	}
+	caller := NewDoQCaller(u.Hostname(), nil)
+	if port := u.Port(); port != "" {
+		caller.Servers = []string{u.Hostname() + ":" + port}
+	}
+	return caller, nil
+}
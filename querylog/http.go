@@ -0,0 +1,80 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ServeQueryLog 处理 GET /querylog?client=...&domain=...&limit=...，按时间倒序返回匹配的记录
+func (l *Logger) ServeQueryLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	client, domain := q.Get("client"), q.Get("domain")
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	records := l.ring.snapshot()
+	out := make([]Record, 0, limit)
+	for i := len(records) - 1; i >= 0 && len(out) < limit; i-- {
+		rec := records[i]
+		if client != "" && rec.ClientIP != client {
+			continue
+		}
+		if domain != "" && rec.QName != domain {
+			continue
+		}
+		out = append(out, rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// statsResponse GET /stats的返回结构
+type statsResponse struct {
+	Client map[string]WindowStats `json:"client,omitempty"`
+	Domain map[string]WindowStats `json:"domain,omitempty"`
+}
+
+// ServeStats 处理 GET /stats?client=...&domain=...，返回最近1m/1h/24h的滚动计数
+func (l *Logger) ServeStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	resp := statsResponse{}
+	if client := q.Get("client"); client != "" {
+		resp.Client = l.stats.ClientSnapshot(client)
+	}
+	if domain := q.Get("domain"); domain != "" {
+		resp.Domain = l.stats.DomainSnapshot(domain)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ServeMetrics 以prometheus文本格式导出累计计数器，供 GET /metrics 使用
+func (l *Logger) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	l.stats.queriesMu.Lock()
+	fmt.Fprintln(w, "# HELP tsdns_queries_total Total number of finished dns queries.")
+	fmt.Fprintln(w, "# TYPE tsdns_queries_total counter")
+	for key, count := range l.stats.queriesTotal {
+		fmt.Fprintf(w, "tsdns_queries_total{group=%q,rcode=%q} %d\n", key[0], key[1], count)
+	}
+	fmt.Fprintln(w, "# HELP tsdns_cache_hits_total Total number of queries answered from cache.")
+	fmt.Fprintln(w, "# TYPE tsdns_cache_hits_total counter")
+	fmt.Fprintf(w, "tsdns_cache_hits_total %d\n", l.stats.cacheHitTotal)
+	l.stats.queriesMu.Unlock()
+
+	l.stats.latencyMu.Lock()
+	fmt.Fprintln(w, "# HELP tsdns_upstream_latency_seconds Upstream query latency in seconds.")
+	fmt.Fprintln(w, "# TYPE tsdns_upstream_latency_seconds summary")
+	for caller, ls := range l.stats.latency {
+		sum, count := ls.snapshot()
+		fmt.Fprintf(w, "tsdns_upstream_latency_seconds_sum{caller=%q} %f\n", caller, sum)
+		fmt.Fprintf(w, "tsdns_upstream_latency_seconds_count{caller=%q} %d\n", caller, count)
+	}
+	l.stats.latencyMu.Unlock()
+}
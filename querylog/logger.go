@@ -0,0 +1,98 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// chanSize Log()使用的缓冲channel大小，channel满了就丢弃新记录而不是阻塞调用方
+const chanSize = 1024
+
+// Logger 记录查询日志：内存环形缓冲区供HTTP接口查询，后台goroutine异步落盘为JSONL并按大小滚动
+type Logger struct {
+	ring    *ring
+	stats   *Stats
+	ch      chan Record
+	path    string
+	maxSize int64
+	file    *os.File
+}
+
+// NewLogger 创建Logger。path为空时只保留内存环形缓冲区，不落盘。maxSize<=0时不滚动
+func NewLogger(path string, ringSize int, maxSize int64) (*Logger, error) {
+	l := &Logger{ring: newRing(ringSize), stats: newStats(), ch: make(chan Record, chanSize), path: path, maxSize: maxSize}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open querylog file %s error: %w", path, err)
+		}
+		l.file = f
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+// Log 非阻塞地提交一条查询记录。ServeDNS应在响应客户端之后调用，channel写入失败时直接丢弃，
+// 以免落盘耗时被计入上游查询延迟
+func (l *Logger) Log(rec Record) {
+	select {
+	case l.ch <- rec:
+	default:
+		log.Debugf("querylog channel full, drop record for %s", rec.QName)
+	}
+}
+
+// ObserveUpstream 记录一次上游查询的耗时，转发给Stats供/metrics导出
+// tsdns_upstream_latency_seconds{caller}使用
+func (l *Logger) ObserveUpstream(caller string, d time.Duration) {
+	l.stats.ObserveUpstream(caller, d)
+}
+
+func (l *Logger) writeLoop() {
+	for rec := range l.ch {
+		l.ring.push(rec)
+		l.stats.Observe(rec)
+		if l.file != nil {
+			l.appendJSONL(rec)
+		}
+	}
+}
+
+func (l *Logger) appendJSONL(rec Record) {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("marshal querylog record error: %v", err)
+		return
+	}
+	if _, err = l.file.Write(append(raw, '\n')); err != nil {
+		log.Errorf("write querylog file error: %v", err)
+		return
+	}
+	l.rotateIfNeeded()
+}
+
+// rotateIfNeeded 当落盘文件超过maxSize时重命名归档并新建一个文件继续写入
+func (l *Logger) rotateIfNeeded() {
+	if l.maxSize <= 0 {
+		return
+	}
+	info, err := l.file.Stat()
+	if err != nil || info.Size() < l.maxSize {
+		return
+	}
+	_ = l.file.Close()
+	rotated := l.path + "." + time.Now().Format("20060102150405")
+	if err = os.Rename(l.path, rotated); err != nil {
+		log.Errorf("rotate querylog file error: %v", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("reopen querylog file error: %v", err)
+		return
+	}
+	l.file = f
+}
@@ -0,0 +1,17 @@
+// Package querylog 记录每条已完成的dns查询，提供环形缓冲区、JSONL落盘、滚动统计及HTTP查询接口
+package querylog
+
+import "time"
+
+// Record 一条已完成的dns查询记录
+type Record struct {
+	Time     time.Time     `json:"time"`
+	ClientIP string        `json:"client_ip"`
+	QName    string        `json:"qname"`
+	QType    string        `json:"qtype"`
+	Group    string        `json:"group"`
+	CacheHit bool          `json:"cache_hit"`
+	Latency  time.Duration `json:"latency_ns"`
+	Answers  []string      `json:"answers,omitempty"`
+	RCode    int           `json:"rcode"`
+}
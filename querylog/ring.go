@@ -0,0 +1,43 @@
+package querylog
+
+import "sync"
+
+// ring 固定大小的环形缓冲区，写满后覆盖最旧的记录
+type ring struct {
+	mu     sync.Mutex
+	buf    []Record
+	next   int
+	filled bool
+}
+
+func newRing(size int) *ring {
+	if size <= 0 {
+		size = 1
+	}
+	return &ring{buf: make([]Record, size)}
+}
+
+func (r *ring) push(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = rec
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.filled = true
+	}
+}
+
+// snapshot 按写入顺序(从旧到新)返回当前缓冲区内的全部记录
+func (r *ring) snapshot() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.filled {
+		out := make([]Record, r.next)
+		copy(out, r.buf[:r.next])
+		return out
+	}
+	out := make([]Record, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	out = append(out, r.buf[:r.next]...)
+	return out
+}
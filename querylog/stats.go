@@ -0,0 +1,191 @@
+package querylog
+
+import (
+	"sync"
+	"time"
+)
+
+// statWindows 滚动统计覆盖的时间窗口
+var statWindows = map[string]time.Duration{
+	"1m": time.Minute, "1h": time.Hour, "24h": 24 * time.Hour,
+}
+
+type statEvent struct {
+	t       time.Time
+	blocked bool
+	cached  bool
+	latency time.Duration
+}
+
+// counter 某个client或某个domain的事件序列，定期裁剪超过最大窗口(24h)的旧事件
+type counter struct {
+	mu     sync.Mutex
+	events []statEvent
+}
+
+func (c *counter) add(ev statEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, ev)
+	cutoff := ev.t.Add(-statWindows["24h"])
+	i := 0
+	for ; i < len(c.events); i++ {
+		if c.events[i].t.After(cutoff) {
+			break
+		}
+	}
+	c.events = c.events[i:]
+}
+
+// WindowStats 某个统计窗口内的聚合结果
+type WindowStats struct {
+	Requests int     `json:"requests"`
+	Blocked  int     `json:"blocked"`
+	Cached   int     `json:"cached"`
+	AvgMs    float64 `json:"avg_latency_ms"`
+}
+
+func (c *counter) summarize(now time.Time, window time.Duration) WindowStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cutoff := now.Add(-window)
+	var st WindowStats
+	var total time.Duration
+	for _, ev := range c.events {
+		if ev.t.Before(cutoff) {
+			continue
+		}
+		st.Requests++
+		if ev.blocked {
+			st.Blocked++
+		}
+		if ev.cached {
+			st.Cached++
+		}
+		total += ev.latency
+	}
+	if st.Requests > 0 {
+		st.AvgMs = float64(total.Milliseconds()) / float64(st.Requests)
+	}
+	return st
+}
+
+// latencySum 某个caller的上游查询耗时累加，用于导出prometheus summary
+type latencySum struct {
+	mu    sync.Mutex
+	sum   float64 // 秒
+	count int64
+}
+
+func (l *latencySum) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sum += d.Seconds()
+	l.count++
+}
+
+func (l *latencySum) snapshot() (sum float64, count int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sum, l.count
+}
+
+// Stats 维护per-client/per-domain的滚动统计，以及prometheus所需的累计计数器
+type Stats struct {
+	mu      sync.Mutex
+	clients map[string]*counter
+	domains map[string]*counter
+
+	queriesMu     sync.Mutex
+	queriesTotal  map[[2]string]int64 // key: [group, rcode]
+	cacheHitTotal int64
+
+	latencyMu sync.Mutex
+	latency   map[string]*latencySum // key: caller
+}
+
+func newStats() *Stats {
+	return &Stats{
+		clients:      map[string]*counter{},
+		domains:      map[string]*counter{},
+		queriesTotal: map[[2]string]int64{},
+		latency:      map[string]*latencySum{},
+	}
+}
+
+func (s *Stats) counterFor(m map[string]*counter, key string) *counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := m[key]
+	if !ok {
+		c = &counter{}
+		m[key] = c
+	}
+	return c
+}
+
+// Observe 记录一条已完成的查询，更新per-client/per-domain滚动统计及累计计数器
+func (s *Stats) Observe(rec Record) {
+	// 命中drop组的查询在resolveGroup中r==nil，ServeDNS最终以Group==""、RCode固定为
+	// dns.RcodeSuccess(0)的空响应兜底，因此blocked只能按Group是否为空判断，不能看RCode。
+	// 命中缓存或hosts的查询Group同样为空，按CacheHit及是否带有应答ip将其排除
+	ev := statEvent{t: rec.Time, blocked: rec.Group == "" && !rec.CacheHit && len(rec.Answers) == 0, cached: rec.CacheHit, latency: rec.Latency}
+	s.counterFor(s.clients, rec.ClientIP).add(ev)
+	s.counterFor(s.domains, rec.QName).add(ev)
+
+	s.queriesMu.Lock()
+	s.queriesTotal[[2]string{rec.Group, rcodeToString(rec.RCode)}]++
+	if rec.CacheHit {
+		s.cacheHitTotal++
+	}
+	s.queriesMu.Unlock()
+}
+
+// ObserveUpstream 记录一次上游查询的耗时，供/metrics导出tsdns_upstream_latency_seconds
+func (s *Stats) ObserveUpstream(caller string, d time.Duration) {
+	s.latencyMu.Lock()
+	l, ok := s.latency[caller]
+	if !ok {
+		l = &latencySum{}
+		s.latency[caller] = l
+	}
+	s.latencyMu.Unlock()
+	l.add(d)
+}
+
+// ClientSnapshot 返回某个client在各个窗口内的滚动统计
+func (s *Stats) ClientSnapshot(client string) map[string]WindowStats {
+	return s.snapshotFrom(s.clients, client)
+}
+
+// DomainSnapshot 返回某个domain在各个窗口内的滚动统计
+func (s *Stats) DomainSnapshot(domain string) map[string]WindowStats {
+	return s.snapshotFrom(s.domains, domain)
+}
+
+func (s *Stats) snapshotFrom(m map[string]*counter, key string) map[string]WindowStats {
+	s.mu.Lock()
+	c, ok := m[key]
+	s.mu.Unlock()
+	if !ok {
+		c = &counter{}
+	}
+	now := time.Now()
+	out := make(map[string]WindowStats, len(statWindows))
+	for name, window := range statWindows {
+		out[name] = c.summarize(now, window)
+	}
+	return out
+}
+
+func rcodeToString(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// rcodeNames 避免引入miekg/dns仅为了rcode转字符串
+var rcodeNames = map[int]string{
+	0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+}
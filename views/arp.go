@@ -0,0 +1,33 @@
+package views
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// LookupMAC 从系统arp表中查出ip对应的mac地址，仅在mac匹配的视图规则存在时才会被调用。
+// 目前只实现了linux(读取/proc/net/arp)，查找失败或平台不支持时返回nil
+func LookupMAC(ip net.IP) net.HardwareAddr {
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // 跳过表头
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[0] == ip.String() {
+			if mac, err := net.ParseMAC(fields[3]); err == nil {
+				return mac
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package views
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SynthesizeECS 按RFC 7871将客户端ip裁剪为/24(ipv4)或/56(ipv6)子网，
+// 作为EDNS Client Subnet的source-prefix-length上报给上游，使CDN能按客户端实际位置就近解析
+func SynthesizeECS(clientIP net.IP) *dns.EDNS0_SUBNET {
+	if ip4 := clientIP.To4(); ip4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: ip4.Mask(mask)}
+	}
+	if ip6 := clientIP.To16(); ip6 != nil {
+		mask := net.CIDRMask(56, 128)
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 56, Address: ip6.Mask(mask)}
+	}
+	return nil
+}
+
+// ParseStaticECS 解析TOML中配置的静态ecs字符串(如"1.2.3.0/24")为EDNS0_SUBNET
+func ParseStaticECS(spec string) (*dns.EDNS0_SUBNET, error) {
+	ip, ipNet, err := net.ParseCIDR(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ecs %q: %w", spec, err)
+	}
+	ones, _ := ipNet.Mask.Size()
+	family := uint16(1)
+	if ip.To4() == nil {
+		family = 2
+	}
+	return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: uint8(ones), Address: ip}, nil
+}
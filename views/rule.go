@@ -0,0 +1,67 @@
+// Package views 实现按客户端来源路由的"视图"：根据客户端所在网段/mac地址覆盖分组、ECS及IPv6开关
+package views
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Rule 对应TOML中的一条[[views]]配置
+type Rule struct {
+	MatchSpec     string `toml:"match"` // client_cidr | "mac:xx:xx:xx:xx:xx:xx" | "if:ifname"
+	GroupOverride string `toml:"group_override"`
+	ECS           string `toml:"ecs"`
+	DisableIPv6   bool   `toml:"disable_ipv6"`
+
+	cidr *net.IPNet
+	mac  string
+}
+
+// Compile 编译Match字段，生成可直接匹配客户端的Rule。interface匹配暂不支持(无法从
+// dns.ResponseWriter获取接收网卡)，直接返回错误，由调用方(group loader)决定是否跳过该条规则
+func Compile(cfg Rule) (*Rule, error) {
+	rule := cfg
+	match := strings.TrimSpace(cfg.MatchSpec)
+	switch {
+	case strings.HasPrefix(match, "mac:"):
+		rule.mac = strings.ToLower(strings.TrimPrefix(match, "mac:"))
+	case strings.HasPrefix(match, "if:"):
+		return nil, fmt.Errorf("view match by interface is not supported yet: %s", match)
+	default:
+		if _, cidr, err := net.ParseCIDR(match); err == nil {
+			rule.cidr = cidr
+		} else if ip := net.ParseIP(match); ip != nil {
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			_, cidr, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ip.String(), bits))
+			rule.cidr = cidr
+		} else {
+			return nil, fmt.Errorf("invalid view match %q", match)
+		}
+	}
+	return &rule, nil
+}
+
+// Match 判断客户端(ip、可能为nil的mac)是否命中该条规则
+func (r *Rule) Match(ip net.IP, mac net.HardwareAddr) bool {
+	if r.cidr != nil {
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	if r.mac != "" {
+		return mac != nil && strings.EqualFold(mac.String(), r.mac)
+	}
+	return false
+}
+
+// CompileECS 将Rule.ECS解析为EDNS0_SUBNET，ECS为空时返回nil
+func (r *Rule) CompileECS() (*dns.EDNS0_SUBNET, error) {
+	if r.ECS == "" {
+		return nil, nil
+	}
+	return ParseStaticECS(r.ECS)
+}